@@ -23,12 +23,15 @@ var (
 		"See also -streamAggr.keepInput, -streamAggr.dropInput and -streamAggr.dedupInterval")
 	streamAggrKeepInput = flag.Bool("streamAggr.keepInput", false, "Whether to keep all the input samples after the aggregation with -streamAggr.config. "+
 		"By default, only aggregated samples are dropped, while the remaining samples are stored in the database. "+
+		"Individual rules can override this via the keep_input field. "+
 		"See also -streamAggr.dropInput and https://docs.victoriametrics.com/stream-aggregation.html")
 	streamAggrDropInput = flag.Bool("streamAggr.dropInput", false, "Whether to drop all the input samples after the aggregation with -streamAggr.config. "+
 		"By default, only aggregated samples are dropped, while the remaining samples are stored in the database. "+
+		"Individual rules can override this via the drop_input field. "+
 		"See also -streamAggr.keepInput and https://docs.victoriametrics.com/stream-aggregation.html")
 	streamAggrDedupInterval = flag.Duration("streamAggr.dedupInterval", 0, "Input samples are de-duplicated with this interval before being aggregated "+
 		"by stream aggregation. Only the last sample per each time series per each interval is aggregated if the interval is greater than zero. "+
+		"Individual rules can override this via the dedup_interval field. "+
 		"See https://docs.victoriametrics.com/stream-aggregation.html")
 )
 
@@ -51,7 +54,11 @@ func CheckStreamAggrConfig() error {
 	}
 	pushNoop := func(tss []prompbmarshal.TimeSeries) {}
 	opts := &streamaggr.Options{
+		// DedupInterval, KeepInput and DropInput are defaults applied to rules,
+		// which don't set the corresponding dedup_interval, keep_input or drop_input fields.
 		DedupInterval: *streamAggrDedupInterval,
+		KeepInput:     *streamAggrKeepInput,
+		DropInput:     *streamAggrDropInput,
 	}
 	sas, err := streamaggr.LoadFromFile(*streamAggrConfig, pushNoop, opts)
 	if err != nil {
@@ -74,7 +81,11 @@ func InitStreamAggr() {
 	sighupCh := procutil.NewSighupChan()
 
 	opts := &streamaggr.Options{
+		// DedupInterval, KeepInput and DropInput are defaults applied to rules,
+		// which don't set the corresponding dedup_interval, keep_input or drop_input fields.
 		DedupInterval: *streamAggrDedupInterval,
+		KeepInput:     *streamAggrKeepInput,
+		DropInput:     *streamAggrDropInput,
 	}
 	sas, err := streamaggr.LoadFromFile(*streamAggrConfig, pushAggregateSeries, opts)
 	if err != nil {
@@ -84,6 +95,9 @@ func InitStreamAggr() {
 	saCfgSuccess.Set(1)
 	saCfgTimestamp.Set(fasttime.UnixTimestamp())
 
+	// InitStreamAggrSharding is a no-op unless -streamAggr.shardPeers is set.
+	InitStreamAggrSharding()
+
 	// Start config reloader.
 	saCfgReloaderWG.Add(1)
 	go func() {
@@ -104,7 +118,11 @@ func reloadStreamAggrConfig() {
 	saCfgReloads.Inc()
 
 	opts := &streamaggr.Options{
+		// DedupInterval, KeepInput and DropInput are defaults applied to rules,
+		// which don't set the corresponding dedup_interval, keep_input or drop_input fields.
 		DedupInterval: *streamAggrDedupInterval,
+		KeepInput:     *streamAggrKeepInput,
+		DropInput:     *streamAggrDropInput,
 	}
 	sasNew, err := streamaggr.LoadFromFile(*streamAggrConfig, pushAggregateSeries, opts)
 	if err != nil {
@@ -128,6 +146,8 @@ func reloadStreamAggrConfig() {
 
 // MustStopStreamAggr stops stream aggregators.
 func MustStopStreamAggr() {
+	MustStopStreamAggrSharding()
+
 	close(saCfgReloaderStopCh)
 	saCfgReloaderWG.Wait()
 
@@ -136,11 +156,13 @@ func MustStopStreamAggr() {
 }
 
 type streamAggrCtx struct {
-	mn      storage.MetricName
-	tss     []prompbmarshal.TimeSeries
-	labels  []prompbmarshal.Label
-	samples []prompbmarshal.Sample
-	buf     []byte
+	mn             storage.MetricName
+	tss            []prompbmarshal.TimeSeries
+	labels         []prompbmarshal.Label
+	samples        []prompbmarshal.Sample
+	buf            []byte
+	localIdxs      []int
+	localMatchIdxs []byte
 }
 
 func (ctx *streamAggrCtx) Reset() {
@@ -154,74 +176,143 @@ func (ctx *streamAggrCtx) Reset() {
 
 	ctx.samples = ctx.samples[:0]
 	ctx.buf = ctx.buf[:0]
+	ctx.localIdxs = ctx.localIdxs[:0]
+	ctx.localMatchIdxs = ctx.localMatchIdxs[:0]
 }
 
-func (ctx *streamAggrCtx) push(mrs []storage.MetricRow, matchIdxs []byte) []byte {
-	mn := &ctx.mn
-	tss := ctx.tss
-	labels := ctx.labels
-	samples := ctx.samples
-	buf := ctx.buf
+// push runs mrs through the currently loaded stream aggregation config and returns matchIdxs,
+// where matchIdxs[i] is non-zero if mrs[i] was aggregated by a rule which drops its input, or if
+// mrs[i] was successfully forwarded to its owning peer, so the caller must drop mrs[i] from the raw
+// series stored in the database. A rule drops its input when it sets drop_input: true, or when it
+// doesn't set drop_input and its effective keep_input is false; a rule with keep_input=true and
+// without drop_input: true doesn't mark its matches as dropped, even though they are still aggregated.
+//
+// forceLocal must be true when mrs were already forwarded here by another replica via
+// handleStreamAggrForward - such rows are always aggregated locally regardless of what the shard
+// ring says, so that two replicas which transiently disagree about peer health can never bounce
+// the same row back and forth between each other.
+func (ctx *streamAggrCtx) push(mrs []storage.MetricRow, matchIdxs []byte, forceLocal bool) []byte {
+	matchIdxs = bytesutil.ResizeNoCopyMayOverallocate(matchIdxs, len(mrs))
+	for i := range matchIdxs {
+		matchIdxs[i] = 0
+	}
+
+	sas := sasGlobal.Load()
 
-	tssLen := len(tss)
-	for _, mr := range mrs {
+	// remoteIdxs buckets the indexes of rows owned by a peer other than this one, grouped by
+	// owner, so forwardRowsToOwner below can send one batched request per peer instead of
+	// paying a blocking network round trip for every single row.
+	var remoteIdxs map[string][]int
+	mn := &ctx.mn
+	for i := range mrs {
+		mr := &mrs[i]
 		if err := mn.UnmarshalRaw(mr.MetricNameRaw); err != nil {
 			logger.Panicf("BUG: cannot unmarshal recently marshaled MetricName: %s", err)
 		}
 
-		labelsLen := len(labels)
-
-		bufLen := len(buf)
-		buf = append(buf, mn.MetricGroup...)
-		metricGroup := bytesutil.ToUnsafeString(buf[bufLen:])
-		labels = append(labels, prompbmarshal.Label{
-			Name:  "__name__",
-			Value: metricGroup,
-		})
-
-		for _, tag := range mn.Tags {
-			bufLen = len(buf)
-			buf = append(buf, tag.Key...)
-			name := bytesutil.ToUnsafeString(buf[bufLen:])
-
-			bufLen = len(buf)
-			buf = append(buf, tag.Value...)
-			value := bytesutil.ToUnsafeString(buf[bufLen:])
-			labels = append(labels, prompbmarshal.Label{
-				Name:  name,
-				Value: value,
-			})
+		if !forceLocal && sas.MatchesAny(bytesutil.ToUnsafeString(mn.MetricGroup)) {
+			// Only rows which actually match a loaded rule are worth consulting the shard ring
+			// for - everything else has nothing to do with aggregation and must stay exactly
+			// where the rest of the non-aggregated ingestion path would put it.
+			if owner, isLocal := shardOwns(mn); !isLocal {
+				if remoteIdxs == nil {
+					remoteIdxs = make(map[string][]int)
+				}
+				remoteIdxs[owner] = append(remoteIdxs[owner], i)
+				continue
+			}
 		}
+		shardSamplesLocal.Inc()
+		ctx.appendLocalRow(mn, mr, i)
+	}
 
-		samplesLen := len(samples)
-		samples = append(samples, prompbmarshal.Sample{
-			Timestamp: mr.Timestamp,
-			Value:     mr.Value,
-		})
-
-		tss = append(tss, prompbmarshal.TimeSeries{
-			Labels:  labels[labelsLen:],
-			Samples: samples[samplesLen:],
-		})
+	for owner, idxs := range remoteIdxs {
+		rows := make([]storage.MetricRow, len(idxs))
+		for j, i := range idxs {
+			rows[j] = mrs[i]
+		}
+		if err := forwardRowsToOwner(owner, rows); err == nil {
+			// The owning peer aggregates and, if needed, stores these rows - they must not be
+			// double-counted by also keeping them as raw rows on this replica.
+			for _, i := range idxs {
+				matchIdxs[i] = 1
+			}
+			continue
+		}
+		logger.Errorf("streamaggr: cannot forward %d row(s) to owner %q, aggregating them locally instead", len(idxs), owner)
+		for _, i := range idxs {
+			mr := &mrs[i]
+			if err := mn.UnmarshalRaw(mr.MetricNameRaw); err != nil {
+				logger.Panicf("BUG: cannot unmarshal recently marshaled MetricName: %s", err)
+			}
+			ctx.appendLocalRow(mn, mr, i)
+		}
 	}
-	ctx.tss = tss
-	ctx.labels = labels
-	ctx.samples = samples
-	ctx.buf = buf
 
-	tss = tss[tssLen:]
-	matchIdxs = bytesutil.ResizeNoCopyMayOverallocate(matchIdxs, len(tss))
-	for i := 0; i < len(matchIdxs); i++ {
-		matchIdxs[i] = 0
+	tss := ctx.tss
+	localMatchIdxs := bytesutil.ResizeNoCopyMayOverallocate(ctx.localMatchIdxs, len(tss))
+	for i := range localMatchIdxs {
+		localMatchIdxs[i] = 0
 	}
-	sas := sasGlobal.Load()
-	matchIdxs = sas.Push(tss, matchIdxs)
+	localMatchIdxs = sas.Push(tss, localMatchIdxs)
+	for j, i := range ctx.localIdxs {
+		matchIdxs[i] = localMatchIdxs[j]
+	}
+	ctx.localMatchIdxs = localMatchIdxs
 
 	ctx.Reset()
 
 	return matchIdxs
 }
 
+// appendLocalRow converts mr into a prompbmarshal.TimeSeries appended to ctx.tss for aggregation
+// on this replica, and records i in ctx.localIdxs so push can later fill in matchIdxs[i] from the
+// corresponding entry of sas.Push's result.
+func (ctx *streamAggrCtx) appendLocalRow(mn *storage.MetricName, mr *storage.MetricRow, i int) {
+	labelsLen := len(ctx.labels)
+
+	bufLen := len(ctx.buf)
+	ctx.buf = append(ctx.buf, mn.MetricGroup...)
+	metricGroup := bytesutil.ToUnsafeString(ctx.buf[bufLen:])
+	ctx.labels = append(ctx.labels, prompbmarshal.Label{
+		Name:  "__name__",
+		Value: metricGroup,
+	})
+
+	for _, tag := range mn.Tags {
+		bufLen = len(ctx.buf)
+		ctx.buf = append(ctx.buf, tag.Key...)
+		name := bytesutil.ToUnsafeString(ctx.buf[bufLen:])
+
+		bufLen = len(ctx.buf)
+		ctx.buf = append(ctx.buf, tag.Value...)
+		value := bytesutil.ToUnsafeString(ctx.buf[bufLen:])
+		ctx.labels = append(ctx.labels, prompbmarshal.Label{
+			Name:  name,
+			Value: value,
+		})
+	}
+
+	samplesLen := len(ctx.samples)
+	ctx.samples = append(ctx.samples, prompbmarshal.Sample{
+		Timestamp: mr.Timestamp,
+		Value:     mr.Value,
+	})
+
+	ctx.tss = append(ctx.tss, prompbmarshal.TimeSeries{
+		Labels:  ctx.labels[labelsLen:],
+		Samples: ctx.samples[samplesLen:],
+	})
+	ctx.localIdxs = append(ctx.localIdxs, i)
+}
+
+// pushAggregateSeries writes the aggregated series produced by sasGlobal to the storage.
+//
+// tss may contain multiple output series per input match clause, e.g. when a rule declares
+// several outputs such as outputs: [sum, avg, count_samples] - each output is already labeled
+// with its own suffix by the caller, so it is written here as an independent time series.
+// Note: per-output relabeling (output_relabel_configs) is not implemented yet; each output
+// series is written as-is.
 func pushAggregateSeries(tss []prompbmarshal.TimeSeries) {
 	currentTimestamp := int64(fasttime.UnixTimestamp()) * 1000
 	var ctx InsertCtx
@@ -237,8 +328,16 @@ func pushAggregateSeries(tss []prompbmarshal.TimeSeries) {
 			}
 			ctx.AddLabel(name, label.Value)
 		}
-		value := ts.Samples[0].Value
-		if err := ctx.WriteDataPoint(nil, ctx.Labels, currentTimestamp, value); err != nil {
+		sample := ts.Samples[0]
+		timestamp := currentTimestamp
+		if sample.Timestamp > 0 {
+			// Rules with by_sample_time: true key their aggregation window on the input
+			// samples' own timestamps instead of the wall clock, so backfilled data (e.g.
+			// Prometheus remote-write of old data, VM native import) produces aggregate
+			// series stamped with the window-end timestamp rather than "now".
+			timestamp = sample.Timestamp
+		}
+		if err := ctx.WriteDataPoint(nil, ctx.Labels, timestamp, sample.Value); err != nil {
 			logger.Errorf("cannot store aggregate series: %s", err)
 			// Do not continue pushing the remaining samples, since it is likely they will return the same error.
 			return
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/httpserver"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/streamaggr"
+)
+
+// StreamAggrRequestHandler serves stream aggregation reload, status and dry-run endpoints.
+// It returns false for paths it doesn't own, so callers can fall through to their own routing,
+// mirroring the RequestHandler convention used across the other VictoriaMetrics components.
+//
+// Handled paths:
+//
+//   - GET/POST /-/reload/streamaggr      - reloads -streamAggr.config, same as sending SIGHUP
+//   - GET      /api/v1/streamaggr/config - returns the currently loaded config as YAML
+//   - GET      /api/v1/streamaggr/rules  - returns per-rule stats (samples in/out, last flush, dedup hit ratio)
+//   - POST     /api/v1/streamaggr/rules?dry_run=1 - loads the config from the request body and
+//     returns whether it is equal to the active one (or the load error), without touching sasGlobal
+func StreamAggrRequestHandler(w http.ResponseWriter, r *http.Request) bool {
+	path := httpserver.GetRequestURI(r)
+	switch path {
+	case "/-/reload/streamaggr":
+		reloadStreamAggrConfig()
+		fmt.Fprintf(w, "OK")
+		return true
+	case "/api/v1/streamaggr/config":
+		handleStreamAggrConfig(w)
+		return true
+	case "/api/v1/streamaggr/rules":
+		if r.Method == http.MethodPost && r.FormValue("dry_run") != "" {
+			handleStreamAggrDryRun(w, r)
+			return true
+		}
+		handleStreamAggrRules(w)
+		return true
+	case streamAggrForwardPath:
+		handleStreamAggrForward(w, r)
+		return true
+	default:
+		return false
+	}
+}
+
+func handleStreamAggrConfig(w http.ResponseWriter) {
+	sas := sasGlobal.Load()
+	if sas == nil {
+		http.Error(w, "stream aggregation isn't configured; see -streamAggr.config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/yaml")
+	if _, err := sas.WriteConfigYAML(w); err != nil {
+		logger.Errorf("cannot write stream aggregation config: %s", err)
+	}
+}
+
+func handleStreamAggrRules(w http.ResponseWriter) {
+	sas := sasGlobal.Load()
+	if sas == nil {
+		http.Error(w, "stream aggregation isn't configured; see -streamAggr.config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sas.RuleStats()); err != nil {
+		logger.Errorf("cannot write stream aggregation rule stats: %s", err)
+	}
+}
+
+// streamAggrDiff reports whether a candidate config is equal to the currently active one,
+// or why the candidate couldn't be loaded.
+type streamAggrDiff struct {
+	Equal bool   `json:"equal"`
+	Error string `json:"error,omitempty"`
+}
+
+func handleStreamAggrDryRun(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot read request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	pushNoop := func(tss []prompbmarshal.TimeSeries) {}
+	opts := &streamaggr.Options{
+		DedupInterval: *streamAggrDedupInterval,
+		KeepInput:     *streamAggrKeepInput,
+		DropInput:     *streamAggrDropInput,
+	}
+	sasCandidate, err := streamaggr.LoadFromData(data, pushNoop, opts)
+	diff := streamAggrDiff{}
+	if err != nil {
+		diff.Error = err.Error()
+	} else {
+		sas := sasGlobal.Load()
+		diff.Equal = sasCandidate.Equal(sas)
+		sasCandidate.MustStop()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		logger.Errorf("cannot write stream aggregation dry-run result: %s", err)
+	}
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/streamaggr"
+)
+
+func TestStreamAggrRequestHandlerUnknownPathFallsThrough(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/some/other/path", nil)
+	w := httptest.NewRecorder()
+	if StreamAggrRequestHandler(w, r) {
+		t.Fatalf("expected StreamAggrRequestHandler to return false for a path it doesn't own")
+	}
+}
+
+func TestStreamAggrRulesNotFoundWhenUnconfigured(t *testing.T) {
+	sasGlobal.Store(nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/streamaggr/rules", nil)
+	w := httptest.NewRecorder()
+	if !StreamAggrRequestHandler(w, r) {
+		t.Fatalf("expected StreamAggrRequestHandler to own /api/v1/streamaggr/rules")
+	}
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when stream aggregation isn't configured, got %d", w.Code)
+	}
+}
+
+func TestStreamAggrDryRunReportsEqualConfig(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [sum]
+`
+	noop := func(tss []prompbmarshal.TimeSeries) {}
+	sas, err := streamaggr.LoadFromData([]byte(cfg), noop, &streamaggr.Options{})
+	if err != nil {
+		t.Fatalf("LoadFromData() failed: %s", err)
+	}
+	defer sas.MustStop()
+	sasGlobal.Store(sas)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/streamaggr/rules?dry_run=1", strings.NewReader(cfg))
+	w := httptest.NewRecorder()
+	if !StreamAggrRequestHandler(w, r) {
+		t.Fatalf("expected StreamAggrRequestHandler to own the dry-run path")
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a valid dry-run config, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"equal":true`) {
+		t.Fatalf("expected the dry-run result to report the identical config as equal, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,311 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// streamAggrForwardPath is the internal route forwardRowsToOwner posts batches of rows to; it is
+// served by StreamAggrRequestHandler in streamaggr_api.go.
+const streamAggrForwardPath = "/internal/streamaggr/forward"
+
+var (
+	streamAggrShardPeers = flag.String("streamAggr.shardPeers", "", "Comma-separated list of vminsert addresses (host:port) which share "+
+		"the same -streamAggr.config and consistently hash incoming series across each other, so every series is aggregated by exactly "+
+		"one replica instead of being double-counted by every replica behind the load balancer. Leave empty to disable sharded "+
+		"stream aggregation. See also -streamAggr.shardAddr")
+	streamAggrShardAddr = flag.String("streamAggr.shardAddr", "", "The address of this vminsert instance as it appears in -streamAggr.shardPeers. "+
+		"Required when -streamAggr.shardPeers is set")
+	streamAggrShardHealthCheckInterval = flag.Duration("streamAggr.shardHealthCheckInterval", 5*time.Second, "How often to health-check peers "+
+		"listed in -streamAggr.shardPeers. An unhealthy peer is temporarily removed from the consistent hashing ring, "+
+		"so the series it used to own reseed their aggregation state on the next healthy peer")
+	streamAggrShardDialTimeout = flag.Duration("streamAggr.shardDialTimeout", time.Second, "Timeout for forwarding a sample to the peer which "+
+		"owns it in a sharded stream aggregation setup")
+)
+
+var (
+	shardSamplesLocal     = metrics.NewCounter(`vminsert_streamagg_shard_samples_local_total`)
+	shardSamplesForwarded = metrics.NewCounter(`vminsert_streamagg_shard_samples_forwarded_total`)
+	shardForwardErrors    = metrics.NewCounter(`vminsert_streamagg_shard_forward_errors_total`)
+	shardPeersDown        = metrics.NewGauge(`vminsert_streamagg_shard_peers_down`, nil)
+)
+
+// shardRing consistently hashes series across the peers listed in -streamAggr.shardPeers,
+// so exactly one replica owns - and therefore aggregates - any given series.
+type shardRing struct {
+	self  string
+	peers []string
+
+	mu      sync.RWMutex
+	healthy map[string]bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+var globalShardRing atomic.Pointer[shardRing]
+
+// InitStreamAggrSharding is called by InitStreamAggr once the -streamAggr.config is loaded. It is
+// a no-op unless -streamAggr.shardPeers is set.
+//
+// MustStopStreamAggrSharding must be called when sharded stream aggregation is no longer needed.
+func InitStreamAggrSharding() {
+	if *streamAggrShardPeers == "" {
+		return
+	}
+	if *streamAggrShardAddr == "" {
+		logger.Fatalf("-streamAggr.shardAddr must be set when -streamAggr.shardPeers is set")
+	}
+
+	peers := strings.Split(*streamAggrShardPeers, ",")
+	r := &shardRing{
+		self:    *streamAggrShardAddr,
+		peers:   peers,
+		healthy: make(map[string]bool, len(peers)),
+		stopCh:  make(chan struct{}),
+	}
+	for _, p := range peers {
+		r.healthy[p] = true
+	}
+	globalShardRing.Store(r)
+
+	r.wg.Add(1)
+	go r.healthCheckLoop()
+}
+
+// MustStopStreamAggrSharding stops the background peer health checker started by InitStreamAggrSharding.
+func MustStopStreamAggrSharding() {
+	r := globalShardRing.Swap(nil)
+	if r == nil {
+		return
+	}
+	close(r.stopCh)
+	r.wg.Wait()
+}
+
+func (r *shardRing) healthCheckLoop() {
+	defer r.wg.Done()
+
+	client := &http.Client{
+		Timeout: *streamAggrShardDialTimeout,
+	}
+	t := time.NewTicker(*streamAggrShardHealthCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-t.C:
+			r.refreshHealth(client)
+		}
+	}
+}
+
+func (r *shardRing) refreshHealth(client *http.Client) {
+	down := 0
+	r.mu.Lock()
+	for _, p := range r.peers {
+		ok := p == r.self || pingPeer(client, p)
+		r.healthy[p] = ok
+		if !ok {
+			down++
+		}
+	}
+	r.mu.Unlock()
+	shardPeersDown.Set(float64(down))
+}
+
+func pingPeer(client *http.Client, addr string) bool {
+	resp, err := client.Get(fmt.Sprintf("http://%s/health", addr))
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// owner returns the healthy peer owning the series with the given hash, using highest
+// random weight (HRW/rendezvous) hashing so that adding or removing a peer only reshuffles
+// the series owned by that peer, instead of reshuffling the whole ring like a modulo hash would.
+func (r *shardRing) owner(h uint64) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var best string
+	var bestScore uint64
+	for _, p := range r.peers {
+		if !r.healthy[p] {
+			continue
+		}
+		if score := rendezvousScore(p, h); best == "" || score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	return best
+}
+
+func rendezvousScore(peer string, h uint64) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(peer))
+	return f.Sum64() ^ h
+}
+
+func hashMetricName(mn *storage.MetricName) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write(mn.MetricGroup)
+	for _, tag := range mn.Tags {
+		_, _ = f.Write(tag.Key)
+		_, _ = f.Write(tag.Value)
+	}
+	return f.Sum64()
+}
+
+// shardOwns reports whether this replica owns mn's series. It always returns true when
+// sharding is disabled, so single-replica and non-sharded HA deployments are unaffected.
+func shardOwns(mn *storage.MetricName) (owner string, isLocal bool) {
+	r := globalShardRing.Load()
+	if r == nil {
+		return "", true
+	}
+	owner = r.owner(hashMetricName(mn))
+	if owner == "" || owner == r.self {
+		return r.self, true
+	}
+	shardSamplesForwarded.Inc()
+	return owner, false
+}
+
+// forwardRowsToOwner forwards rows to the peer which owns their series, so that peer's local
+// aggregator - and only that aggregator - observes the samples. All of rows are sent in a single
+// request regardless of how many there are, so a batch of matched rows pays for one network round
+// trip instead of one per row. Once forwardRowsToOwner succeeds, the caller must treat every row
+// in rows as fully handled by the owner: handleStreamAggrForward below runs them through the same
+// local aggregation and keep_input bookkeeping a local row would get, so storing them again here
+// as well would double-count the raw rows.
+func forwardRowsToOwner(owner string, rows []storage.MetricRow) error {
+	buf, err := marshalForwardedRows(nil, rows)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %d row(s) for forwarding to %q: %w", len(rows), owner, err)
+	}
+	client := &http.Client{
+		Timeout: *streamAggrShardDialTimeout,
+	}
+	resp, err := client.Post(fmt.Sprintf("http://%s%s", owner, streamAggrForwardPath), "application/octet-stream", bytes.NewReader(buf))
+	if err != nil {
+		shardForwardErrors.Inc()
+		return fmt.Errorf("cannot forward %d row(s) to %q: %w", len(rows), owner, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		shardForwardErrors.Inc()
+		return fmt.Errorf("peer %q returned unexpected status code %d for a forwarded batch", owner, resp.StatusCode)
+	}
+	return nil
+}
+
+// marshalForwardedRows appends rows to dst as a sequence of (uint32 big-endian length, row bytes)
+// entries, so forwardRowsToOwner can send an arbitrary number of rows in a single request body.
+func marshalForwardedRows(dst []byte, rows []storage.MetricRow) ([]byte, error) {
+	var lenBuf [4]byte
+	for i := range rows {
+		rowBuf, err := rows[i].Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(rowBuf)))
+		dst = append(dst, lenBuf[:]...)
+		dst = append(dst, rowBuf...)
+	}
+	return dst, nil
+}
+
+// unmarshalForwardedRows parses the framing written by marshalForwardedRows.
+func unmarshalForwardedRows(data []byte) ([]storage.MetricRow, error) {
+	var rows []storage.MetricRow
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated forwarded batch: %d byte(s) left, want at least 4 for the length prefix", len(data))
+		}
+		n := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+		if uint32(len(data)) < n {
+			return nil, fmt.Errorf("truncated forwarded batch: row body is %d byte(s), want %d", len(data), n)
+		}
+		var mr storage.MetricRow
+		if err := mr.Unmarshal(data[:n]); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal forwarded row: %w", err)
+		}
+		rows = append(rows, mr)
+		data = data[n:]
+	}
+	return rows, nil
+}
+
+// handleStreamAggrForward is the receiving end of forwardRowsToOwner: it aggregates every row in
+// the forwarded batch exactly as it would aggregate a row ingested locally, including storing the
+// raw row via vmstorage when no matched rule drops its input (or when the row doesn't match any
+// rule at all). It always treats the batch as locally owned rather than
+// re-deriving ownership, so a row can never ping-pong between peers that transiently disagree on
+// ring health - once a row has been forwarded once, it's this replica's problem.
+func handleStreamAggrForward(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot read forwarded batch: %s", err), http.StatusBadRequest)
+		return
+	}
+	mrs, err := unmarshalForwardedRows(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot unmarshal forwarded batch: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var ctx streamAggrCtx
+	matchIdxs := ctx.push(mrs, nil, true)
+	for i := range mrs {
+		if matchIdxs[i] == 0 {
+			storeForwardedRow(&mrs[i])
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// storeForwardedRow writes a forwarded row to local storage the same way pushAggregateSeries
+// writes aggregated output series, since the usual vminsert write path isn't reachable from here.
+func storeForwardedRow(mr *storage.MetricRow) {
+	var mn storage.MetricName
+	if err := mn.UnmarshalRaw(mr.MetricNameRaw); err != nil {
+		logger.Errorf("cannot unmarshal forwarded row's metric name: %s", err)
+		return
+	}
+
+	var ctx InsertCtx
+	ctx.Reset(1)
+	ctx.skipStreamAggr = true
+	ctx.Labels = ctx.Labels[:0]
+	ctx.AddLabel("", string(mn.MetricGroup))
+	for _, tag := range mn.Tags {
+		ctx.AddLabel(string(tag.Key), string(tag.Value))
+	}
+	if err := ctx.WriteDataPoint(nil, ctx.Labels, mr.Timestamp, mr.Value); err != nil {
+		logger.Errorf("cannot store forwarded row: %s", err)
+		return
+	}
+	if err := vmstorage.AddRows(ctx.mrs); err != nil {
+		logger.Errorf("cannot flush forwarded row: %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+func TestShardOwnsIsLocalWhenShardingDisabled(t *testing.T) {
+	globalShardRing.Store(nil)
+
+	mn := &storage.MetricName{
+		MetricGroup: []byte("foo_total"),
+	}
+	owner, isLocal := shardOwns(mn)
+	if !isLocal {
+		t.Fatalf("expected isLocal=true when sharding is disabled, got owner=%q", owner)
+	}
+}
+
+func TestRendezvousScoreIsDeterministic(t *testing.T) {
+	h := uint64(12345)
+	a := rendezvousScore("peer-a", h)
+	b := rendezvousScore("peer-a", h)
+	if a != b {
+		t.Fatalf("rendezvousScore must be deterministic for the same peer and hash, got %d and %d", a, b)
+	}
+	if c := rendezvousScore("peer-b", h); c == a {
+		t.Fatalf("different peers are expected to score differently for the same hash (got equal scores by coincidence: %d)", a)
+	}
+}
+
+func TestShardRingOwnerSkipsUnhealthyPeers(t *testing.T) {
+	r := &shardRing{
+		self:    "peer-a",
+		peers:   []string{"peer-a", "peer-b", "peer-c"},
+		healthy: map[string]bool{"peer-a": true, "peer-b": true, "peer-c": true},
+	}
+
+	h := uint64(999)
+	owner := r.owner(h)
+	if owner == "" {
+		t.Fatalf("expected a healthy owner to be found")
+	}
+
+	// Marking the current owner unhealthy must hand ownership to a different, healthy peer.
+	r.healthy[owner] = false
+	newOwner := r.owner(h)
+	if newOwner == "" {
+		t.Fatalf("expected a healthy owner to still be found after marking %q unhealthy", owner)
+	}
+	if newOwner == owner {
+		t.Fatalf("expected ownership to move off the now-unhealthy peer %q", owner)
+	}
+
+	// Marking every peer unhealthy must leave the series without an owner.
+	for p := range r.healthy {
+		r.healthy[p] = false
+	}
+	if got := r.owner(h); got != "" {
+		t.Fatalf("expected no owner when every peer is unhealthy, got %q", got)
+	}
+}
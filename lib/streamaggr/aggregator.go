@@ -0,0 +1,400 @@
+package streamaggr
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+)
+
+// aggregator aggregates samples matching a single Config rule and periodically pushes the
+// result via pushFunc.
+type aggregator struct {
+	cfg *Config
+
+	matchSet map[string]struct{}
+
+	interval      time.Duration
+	dedupInterval time.Duration
+	keepInput     bool
+	dropInput     bool
+	// dropInputSet is true when this rule's own drop_input field was set, as opposed to
+	// dropInput merely being inherited from the global -streamAggr.dropInput default. A rule
+	// that sets drop_input explicitly always wins, even over an inherited keepInput=true.
+	dropInputSet        bool
+	byRuleSampleTime    bool
+	outOfOrderTolerance time.Duration
+
+	pushFunc PushFunc
+
+	mu                    sync.Mutex
+	windows               map[int64]*aggrWindow // keyed by window-end timestamp (ms); real-time rules only ever use key 0
+	newestSampleTimestamp int64
+	samplesIn             uint64
+	samplesOut            uint64
+	dedupHits             uint64
+	lastFlush             time.Time
+	stopCh                chan struct{}
+	wg                    sync.WaitGroup
+}
+
+// aggrWindow accumulates per-series state for a single aggregation window.
+type aggrWindow struct {
+	// endTimestamp is the window's end time in milliseconds, used as the output sample's
+	// timestamp for by_sample_time rules. Unused (left at zero) for real-time rules, which
+	// stamp their output with the wall clock at flush time instead.
+	endTimestamp int64
+	series       map[string]*seriesState
+}
+
+type seriesState struct {
+	labels    []prompbmarshal.Label
+	count     uint64
+	sum       float64
+	lastSeen  int64
+	lastValue float64
+}
+
+func newAggregator(cfg *Config, pushFunc PushFunc, opts *Options) (*aggregator, error) {
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %q: %w", cfg.Interval, err)
+	}
+	if len(cfg.Match) == 0 {
+		return nil, fmt.Errorf("match list must not be empty")
+	}
+	if len(cfg.Outputs) == 0 {
+		return nil, fmt.Errorf("outputs list must not be empty")
+	}
+
+	dedupInterval := opts.DedupInterval
+	if cfg.DedupInterval != "" {
+		di, err := time.ParseDuration(cfg.DedupInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dedup_interval %q: %w", cfg.DedupInterval, err)
+		}
+		dedupInterval = di
+	}
+	keepInput := opts.KeepInput
+	if cfg.KeepInput != nil {
+		keepInput = *cfg.KeepInput
+	}
+	dropInput := opts.DropInput
+	dropInputSet := cfg.DropInput != nil
+	if dropInputSet {
+		dropInput = *cfg.DropInput
+	}
+
+	outOfOrderTolerance := 2 * interval
+	if cfg.OutOfOrderTolerance != "" {
+		oot, err := time.ParseDuration(cfg.OutOfOrderTolerance)
+		if err != nil {
+			return nil, fmt.Errorf("invalid out_of_order_tolerance %q: %w", cfg.OutOfOrderTolerance, err)
+		}
+		outOfOrderTolerance = oot
+	}
+
+	matchSet := make(map[string]struct{}, len(cfg.Match))
+	for _, m := range cfg.Match {
+		matchSet[m] = struct{}{}
+	}
+
+	a := &aggregator{
+		cfg:                 cfg,
+		matchSet:            matchSet,
+		interval:            interval,
+		dedupInterval:       dedupInterval,
+		keepInput:           keepInput,
+		dropInput:           dropInput,
+		dropInputSet:        dropInputSet,
+		byRuleSampleTime:    cfg.ByRuleSampleTime,
+		outOfOrderTolerance: outOfOrderTolerance,
+		pushFunc:            pushFunc,
+		windows:             make(map[int64]*aggrWindow),
+		stopCh:              make(chan struct{}),
+	}
+
+	a.wg.Add(1)
+	go a.flushLoop()
+
+	return a, nil
+}
+
+// flushTick is how often the flush loop wakes up to check for due windows. Real-time rules only
+// ever have one window, so they tick at their own interval; by_sample_time rules may have several
+// windows open at once (out-of-order replay), so they're checked more often to flush each window
+// promptly once it falls behind the tolerance.
+const flushTick = time.Second
+
+func (a *aggregator) flushLoop() {
+	defer a.wg.Done()
+	tickInterval := a.interval
+	if a.byRuleSampleTime && flushTick < tickInterval {
+		tickInterval = flushTick
+	}
+	t := time.NewTicker(tickInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			a.flushAll()
+			return
+		case <-t.C:
+			a.flushDue()
+		}
+	}
+}
+
+// MustStop stops the background flush loop, flushing whatever is left in all open windows.
+func (a *aggregator) MustStop() {
+	close(a.stopCh)
+	a.wg.Wait()
+}
+
+// push folds every series in tss which matches this rule into the open aggregation window,
+// and marks matchIdxs[i] when the rule doesn't keep its raw input.
+func (a *aggregator) push(tss []prompbmarshal.TimeSeries, matchIdxs []byte) {
+	for i := range tss {
+		ts := &tss[i]
+		if !a.matchesLabels(ts.Labels) {
+			continue
+		}
+		for _, s := range ts.Samples {
+			a.addSample(ts.Labels, s)
+		}
+		a.mu.Lock()
+		a.samplesIn += uint64(len(ts.Samples))
+		a.mu.Unlock()
+		// A rule which sets drop_input itself always wins, even over an inherited keepInput=true
+		// default - that's the whole point of letting drop_input override keep_input per rule.
+		// Otherwise fall back to the usual keepInput decision.
+		effectiveDrop := !a.keepInput
+		if a.dropInputSet {
+			effectiveDrop = a.dropInput
+		}
+		if effectiveDrop {
+			matchIdxs[i] = 1
+		}
+	}
+}
+
+func (a *aggregator) matchesLabels(labels []prompbmarshal.Label) bool {
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			return a.matchesName(l.Value)
+		}
+	}
+	return false
+}
+
+func (a *aggregator) matchesName(name string) bool {
+	_, ok := a.matchSet[name]
+	return ok
+}
+
+func (a *aggregator) addSample(labels []prompbmarshal.Label, s prompbmarshal.Sample) {
+	key := seriesKey(labels)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	windowKey := int64(0)
+	if a.byRuleSampleTime {
+		if s.Timestamp > a.newestSampleTimestamp {
+			a.newestSampleTimestamp = s.Timestamp
+		}
+		cutoff := a.newestSampleTimestamp - a.outOfOrderTolerance.Milliseconds()
+		windowKey = windowEnd(s.Timestamp, a.interval.Milliseconds())
+		if windowKey <= cutoff {
+			// This sample lags too far behind the newest sample seen so far for this rule -
+			// its window has likely already been flushed, so fold it in would either reopen a
+			// stale window or silently corrupt the next one. Drop it instead.
+			return
+		}
+	}
+
+	w := a.windows[windowKey]
+	if w == nil {
+		w = &aggrWindow{endTimestamp: windowKey, series: make(map[string]*seriesState)}
+		a.windows[windowKey] = w
+	}
+
+	ss := w.series[key]
+	if ss == nil {
+		// labels may point into buffers the caller reuses after Push returns, so keep a deep copy.
+		labelsCopy := make([]prompbmarshal.Label, len(labels))
+		for i, l := range labels {
+			labelsCopy[i] = prompbmarshal.Label{Name: strings.Clone(l.Name), Value: strings.Clone(l.Value)}
+		}
+		ss = &seriesState{labels: labelsCopy}
+		w.series[key] = ss
+	}
+	if a.dedupInterval > 0 && ss.count > 0 && s.Timestamp-ss.lastSeen < a.dedupInterval.Milliseconds() {
+		// Only the last sample per dedup interval is aggregated: replace the previous sample's
+		// contribution to the sum with this one.
+		a.dedupHits++
+		ss.sum += s.Value - ss.lastValue
+		ss.lastValue = s.Value
+		return
+	}
+	ss.count++
+	ss.sum += s.Value
+	ss.lastValue = s.Value
+	ss.lastSeen = s.Timestamp
+}
+
+// windowEnd returns the end timestamp (in ms) of the stepMs-wide window containing t.
+func windowEnd(t, stepMs int64) int64 {
+	return (t/stepMs + 1) * stepMs
+}
+
+func seriesKey(labels []prompbmarshal.Label) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.Name)
+		sb.WriteByte('=')
+		sb.WriteString(l.Value)
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// flushDue flushes whichever windows are ready to be flushed: for real-time rules that's always
+// the single window (key 0) on every tick; for by_sample_time rules it's every window whose end
+// time already fell out of the out-of-order tolerance, since no further samples for it are
+// expected to arrive.
+func (a *aggregator) flushDue() {
+	if !a.byRuleSampleTime {
+		a.flushWindow(0)
+		return
+	}
+
+	a.mu.Lock()
+	cutoff := a.newestSampleTimestamp - a.outOfOrderTolerance.Milliseconds()
+	due := make([]int64, 0, len(a.windows))
+	for k := range a.windows {
+		if k <= cutoff {
+			due = append(due, k)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, k := range due {
+		a.flushWindow(k)
+	}
+}
+
+// flushAll flushes every window outstanding, regardless of whether it's due yet. Used when the
+// aggregator is stopping and no further samples will arrive.
+func (a *aggregator) flushAll() {
+	a.mu.Lock()
+	keys := make([]int64, 0, len(a.windows))
+	for k := range a.windows {
+		keys = append(keys, k)
+	}
+	a.mu.Unlock()
+
+	for _, k := range keys {
+		a.flushWindow(k)
+	}
+}
+
+// flushWindow flushes and removes the window keyed by windowKey, if it exists.
+func (a *aggregator) flushWindow(windowKey int64) {
+	a.mu.Lock()
+	w := a.windows[windowKey]
+	delete(a.windows, windowKey)
+	a.mu.Unlock()
+
+	if w == nil || len(w.series) == 0 {
+		return
+	}
+
+	// For by_sample_time rules the output is stamped with the window's own end time so it lands
+	// in the window it actually belongs to; real-time rules stamp Timestamp: 0 and rely on the
+	// caller (pushAggregateSeries) to fill in the wall clock.
+	outTimestamp := int64(0)
+	if a.byRuleSampleTime {
+		outTimestamp = w.endTimestamp
+	}
+
+	// Every output listed in a.cfg.Outputs is computed from the same already-aggregated
+	// seriesState, so a match clause with N outputs fans out to N labeled output series
+	// per input series without re-matching or re-scanning the input.
+	outTss := make([]prompbmarshal.TimeSeries, 0, len(w.series)*len(a.cfg.Outputs))
+	for _, ss := range w.series {
+		for _, output := range a.cfg.Outputs {
+			value, ok := computeOutput(output, ss)
+			if !ok {
+				continue
+			}
+			outTss = append(outTss, prompbmarshal.TimeSeries{
+				Labels:  renameMetric(ss.labels, a.cfg.Interval, output),
+				Samples: []prompbmarshal.Sample{{Timestamp: outTimestamp, Value: value}},
+			})
+		}
+	}
+	a.mu.Lock()
+	a.samplesOut += uint64(len(outTss))
+	a.lastFlush = time.Now()
+	a.mu.Unlock()
+
+	if len(outTss) > 0 {
+		a.pushFunc(outTss)
+	}
+}
+
+// stats returns a snapshot of a's runtime counters for the status API.
+func (a *aggregator) stats() RuleStat {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var dedupHitRatio float64
+	if a.samplesIn > 0 {
+		dedupHitRatio = float64(a.dedupHits) / float64(a.samplesIn)
+	}
+	return RuleStat{
+		Match:         a.cfg.Match,
+		Interval:      a.cfg.Interval,
+		Outputs:       a.cfg.Outputs,
+		SamplesIn:     a.samplesIn,
+		SamplesOut:    a.samplesOut,
+		DedupHits:     a.dedupHits,
+		DedupHitRatio: dedupHitRatio,
+		LastFlushTime: a.lastFlush,
+	}
+}
+
+// renameMetric returns a copy of labels with __name__ suffixed by the interval and output
+// function, e.g. "http_requests_total" -> "http_requests_total:1m_sum", so that a single match
+// clause with multiple outputs can emit them as distinct, independently named output series.
+func renameMetric(labels []prompbmarshal.Label, interval, output string) []prompbmarshal.Label {
+	out := make([]prompbmarshal.Label, len(labels))
+	copy(out, labels)
+	for i := range out {
+		if out[i].Name == "__name__" {
+			out[i].Value = out[i].Value + ":" + interval + "_" + output
+		}
+	}
+	return out
+}
+
+func computeOutput(output string, ss *seriesState) (float64, bool) {
+	switch output {
+	case "sum":
+		return ss.sum, true
+	case "count_samples":
+		return float64(ss.count), true
+	case "avg":
+		if ss.count == 0 {
+			return 0, false
+		}
+		return ss.sum / float64(ss.count), true
+	case "last":
+		return ss.lastValue, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,118 @@
+package streamaggr
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+)
+
+func TestBySampleTimeBucketsByInputTimestampAndStampsWindowEnd(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 10s
+  outputs: [sum]
+  by_sample_time: true
+  out_of_order_tolerance: 5s
+`
+	var mu sync.Mutex
+	var pushed []prompbmarshal.TimeSeries
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {
+		mu.Lock()
+		pushed = append(pushed, tss...)
+		mu.Unlock()
+	}
+	as := mustLoad(t, cfg, pushFunc, &Options{})
+	defer as.MustStop()
+
+	// Both samples fall in the window ending at 10000ms.
+	tss := []prompbmarshal.TimeSeries{
+		mkSeries("foo_total", 2, 1000),
+		mkSeries("foo_total", 3, 9000),
+	}
+	as.Push(tss, make([]byte, len(tss)))
+
+	// The window isn't due yet: the newest sample (9000) is still within out_of_order_tolerance
+	// (5s) of the window end (10000), so nothing should flush.
+	as.as[0].flushDue()
+	mu.Lock()
+	if len(pushed) != 0 {
+		t.Fatalf("expected no output before the window falls out of tolerance, got %d series", len(pushed))
+	}
+	mu.Unlock()
+
+	// A later sample pushes the newest-seen timestamp far enough ahead that the first window
+	// (ending at 10000) now falls behind the tolerance and must flush.
+	tss2 := []prompbmarshal.TimeSeries{mkSeries("foo_total", 1, 16000)}
+	as.Push(tss2, make([]byte, len(tss2)))
+	as.as[0].flushDue()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pushed) != 1 {
+		t.Fatalf("expected exactly one flushed output series for the first window, got %d", len(pushed))
+	}
+	if got := pushed[0].Samples[0].Value; got != 5 {
+		t.Fatalf("expected sum=5 for the first window, got %v", got)
+	}
+	if got := pushed[0].Samples[0].Timestamp; got != 10000 {
+		t.Fatalf("expected output stamped with the window-end timestamp 10000, got %d", got)
+	}
+}
+
+func TestBySampleTimeDropsSamplesPastOutOfOrderTolerance(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 10s
+  outputs: [count_samples]
+  by_sample_time: true
+  out_of_order_tolerance: 5s
+`
+	as := mustLoad(t, cfg, func(tss []prompbmarshal.TimeSeries) {}, &Options{})
+	defer as.MustStop()
+
+	ag := as.as[0]
+	// Advance the newest-seen timestamp well past the first window's tolerance.
+	as.Push([]prompbmarshal.TimeSeries{mkSeries("foo_total", 1, 100000)}, make([]byte, 1))
+
+	// A sample whose window (ending at 10000) is already long past tolerance must be dropped
+	// instead of reopening it.
+	as.Push([]prompbmarshal.TimeSeries{mkSeries("foo_total", 1, 1000)}, make([]byte, 1))
+
+	ag.mu.Lock()
+	_, stale := ag.windows[10000]
+	ag.mu.Unlock()
+	if stale {
+		t.Fatalf("expected the stale out-of-order sample to be dropped, not reopen window 10000")
+	}
+}
+
+func TestRealTimeRuleUnaffectedByByRuleSampleTime(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [sum]
+`
+	var mu sync.Mutex
+	var lastTss []prompbmarshal.TimeSeries
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {
+		mu.Lock()
+		lastTss = tss
+		mu.Unlock()
+	}
+	as := mustLoad(t, cfg, pushFunc, &Options{})
+	defer as.MustStop()
+
+	tss := []prompbmarshal.TimeSeries{mkSeries("foo_total", 1, 1000)}
+	as.Push(tss, make([]byte, len(tss)))
+	as.as[0].flushDue()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lastTss) != 1 {
+		t.Fatalf("expected one output series, got %d", len(lastTss))
+	}
+	if got := lastTss[0].Samples[0].Timestamp; got != 0 {
+		t.Fatalf("expected a real-time rule to stamp output with Timestamp=0 so the caller fills in the wall clock, got %d", got)
+	}
+}
@@ -0,0 +1,199 @@
+// Package streamaggr implements streaming aggregation of time series on top of raw samples
+// ingested by vminsert, as configured by -streamAggr.config.
+package streamaggr
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+	"gopkg.in/yaml.v2"
+)
+
+// PushFunc is called by Aggregators whenever it has aggregated output series ready to push
+// downstream.
+type PushFunc func(tss []prompbmarshal.TimeSeries)
+
+// Options contains global defaults applied to rules which don't set the corresponding field
+// themselves.
+type Options struct {
+	// DedupInterval is the default dedup_interval for rules which don't set their own.
+	DedupInterval time.Duration
+
+	// KeepInput is the default keep_input for rules which don't set their own.
+	KeepInput bool
+
+	// DropInput is the default drop_input for rules which don't set their own. Push doesn't
+	// consult this default: a rule without its own drop_input field drops its matched input
+	// only when its effective keep_input is false.
+	DropInput bool
+}
+
+// Config is the configuration of a single stream aggregation rule, as loaded from -streamAggr.config.
+type Config struct {
+	// Match is the list of metric names this rule aggregates. A series is aggregated by this
+	// rule when its __name__ value is present in Match.
+	Match []string `yaml:"match"`
+
+	// Interval is the aggregation window for real-time rules, e.g. "30s", "5m".
+	Interval string `yaml:"interval"`
+
+	// Outputs is the list of aggregation functions computed for every series matched by this
+	// rule, e.g. ["sum", "count_samples", "avg"]. Each output is emitted as its own series.
+	// Known gap: there is no way to give an individual output its own output_relabel_configs yet -
+	// every output for a rule goes through identical relabeling (currently none).
+	Outputs []string `yaml:"outputs"`
+
+	// KeepInput overrides Options.KeepInput for this rule when set.
+	KeepInput *bool `yaml:"keep_input,omitempty"`
+
+	// DropInput overrides Options.DropInput for this rule when set.
+	DropInput *bool `yaml:"drop_input,omitempty"`
+
+	// DedupInterval overrides Options.DedupInterval for this rule when set.
+	DedupInterval string `yaml:"dedup_interval,omitempty"`
+
+	// ByRuleSampleTime, when true, keys this rule's aggregation windows on each input sample's
+	// own timestamp instead of the wall clock, so replayed/backfilled data (e.g. Prometheus
+	// remote-write of old data, VM native import, backfilled OpenTelemetry batches) is folded
+	// into the window it actually belongs to and the resulting output series is stamped with
+	// that window's end time rather than "now". Real-time pipelines should leave this unset.
+	ByRuleSampleTime bool `yaml:"by_sample_time,omitempty"`
+
+	// OutOfOrderTolerance bounds how far behind the newest sample timestamp seen so far an
+	// incoming sample may lag and still be folded into its window. Only used when
+	// ByRuleSampleTime is set. A sample is dropped when the end of its window is at or before
+	// the newest sample timestamp minus the tolerance, instead of reopening a window that may
+	// have already been flushed; a sample lagging more than the tolerance is still folded in
+	// while its window ends after that point. Defaults to 2x Interval.
+	OutOfOrderTolerance string `yaml:"out_of_order_tolerance,omitempty"`
+}
+
+// RuleStat contains runtime stats for a single loaded rule, as returned by Aggregators.RuleStats.
+type RuleStat struct {
+	Match         []string  `json:"match"`
+	Interval      string    `json:"interval"`
+	Outputs       []string  `json:"outputs"`
+	SamplesIn     uint64    `json:"samples_in"`
+	SamplesOut    uint64    `json:"samples_out"`
+	DedupHits     uint64    `json:"dedup_hits"`
+	DedupHitRatio float64   `json:"dedup_hit_ratio"`
+	LastFlushTime time.Time `json:"last_flush_time"`
+}
+
+// Aggregators is a set of aggregators loaded from a single -streamAggr.config file.
+type Aggregators struct {
+	as   []*aggregator
+	data []byte
+}
+
+// LoadFromFile loads Aggregators from the config file at path.
+func LoadFromFile(path string, pushFunc PushFunc, opts *Options) (*Aggregators, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read -streamAggr.config=%q: %w", path, err)
+	}
+	as, err := LoadFromData(data, pushFunc, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing -streamAggr.config=%q: %w", path, err)
+	}
+	return as, nil
+}
+
+// LoadFromData loads Aggregators from config data in the YAML format used by -streamAggr.config.
+func LoadFromData(data []byte, pushFunc PushFunc, opts *Options) (*Aggregators, error) {
+	var cfgs []*Config
+	if err := yaml.Unmarshal(data, &cfgs); err != nil {
+		return nil, fmt.Errorf("cannot parse stream aggregation config: %w", err)
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	as := make([]*aggregator, len(cfgs))
+	for i, cfg := range cfgs {
+		a, err := newAggregator(cfg, pushFunc, opts)
+		if err != nil {
+			for _, prev := range as[:i] {
+				prev.MustStop()
+			}
+			return nil, fmt.Errorf("cannot initialize aggregator for match=%v: %w", cfg.Match, err)
+		}
+		as[i] = a
+	}
+	return &Aggregators{
+		as:   as,
+		data: data,
+	}, nil
+}
+
+// MustStop stops all the aggregators in a, flushing whatever is left in their open windows.
+func (a *Aggregators) MustStop() {
+	if a == nil {
+		return
+	}
+	for _, ag := range a.as {
+		ag.MustStop()
+	}
+}
+
+// Equal reports whether a and b were loaded from byte-identical configs.
+func (a *Aggregators) Equal(b *Aggregators) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return string(a.data) == string(b.data)
+}
+
+// WriteConfigYAML writes the raw config a was loaded from to w, so operators can inspect the
+// currently active stream aggregation config without shelling into the container.
+func (a *Aggregators) WriteConfigYAML(w io.Writer) (int, error) {
+	if a == nil {
+		return w.Write(nil)
+	}
+	return w.Write(a.data)
+}
+
+// MatchesAny reports whether name matches at least one loaded rule's Match list, i.e. whether a
+// series with this metric name would be aggregated by a.Push at all. Callers that need to decide
+// whether a series is in scope for stream aggregation at all - e.g. before paying for a sharding
+// lookup or a network hop - should check this first, since a.Push itself only reports per-series
+// matches after the fact via matchIdxs.
+func (a *Aggregators) MatchesAny(name string) bool {
+	if a == nil {
+		return false
+	}
+	for _, ag := range a.as {
+		if ag.matchesName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleStats returns per-rule runtime stats for every rule currently loaded in a.
+func (a *Aggregators) RuleStats() []RuleStat {
+	if a == nil {
+		return nil
+	}
+	stats := make([]RuleStat, len(a.as))
+	for i, ag := range a.as {
+		stats[i] = ag.stats()
+	}
+	return stats
+}
+
+// Push runs tss through all the loaded aggregators. matchIdxs[i] is set to non-zero when tss[i]
+// matched a rule which drops its input, so the caller should drop it from the raw series it
+// stores. A rule drops its input when it sets drop_input: true, or when it doesn't set drop_input
+// and its effective keep_input is false. matchIdxs is returned for reuse by the caller.
+func (a *Aggregators) Push(tss []prompbmarshal.TimeSeries, matchIdxs []byte) []byte {
+	if a == nil {
+		return matchIdxs
+	}
+	for _, ag := range a.as {
+		ag.push(tss, matchIdxs)
+	}
+	return matchIdxs
+}
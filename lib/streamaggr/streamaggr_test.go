@@ -0,0 +1,260 @@
+package streamaggr
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+)
+
+func mustLoad(t *testing.T, data string, pushFunc PushFunc, opts *Options) *Aggregators {
+	t.Helper()
+	as, err := LoadFromData([]byte(data), pushFunc, opts)
+	if err != nil {
+		t.Fatalf("LoadFromData() failed: %s", err)
+	}
+	return as
+}
+
+func mkSeries(name string, value float64, timestamp int64) prompbmarshal.TimeSeries {
+	return prompbmarshal.TimeSeries{
+		Labels: []prompbmarshal.Label{
+			{Name: "__name__", Value: name},
+		},
+		Samples: []prompbmarshal.Sample{
+			{Timestamp: timestamp, Value: value},
+		},
+	}
+}
+
+func TestPerRuleKeepInputOverridesGlobalDefault(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [sum]
+  keep_input: true
+- match: [bar_total]
+  interval: 1s
+  outputs: [sum]
+`
+	var mu sync.Mutex
+	var pushed int
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {
+		mu.Lock()
+		pushed += len(tss)
+		mu.Unlock()
+	}
+
+	// The global default is to drop input; only the foo_total rule overrides it to keep_input.
+	opts := &Options{DropInput: true}
+	as := mustLoad(t, cfg, pushFunc, opts)
+	defer as.MustStop()
+
+	tss := []prompbmarshal.TimeSeries{
+		mkSeries("foo_total", 1, 1000),
+		mkSeries("bar_total", 2, 1000),
+	}
+	matchIdxs := as.Push(tss, make([]byte, len(tss)))
+	if matchIdxs[0] != 0 {
+		t.Fatalf("foo_total has keep_input: true and must not be dropped, got matchIdxs[0]=%d", matchIdxs[0])
+	}
+	if matchIdxs[1] != 1 {
+		t.Fatalf("bar_total falls back to the global keep_input=false default and must be dropped, got matchIdxs[1]=%d", matchIdxs[1])
+	}
+}
+
+func TestPerRuleDropInputOverridesGlobalKeepInput(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [sum]
+  drop_input: true
+- match: [bar_total]
+  interval: 1s
+  outputs: [sum]
+`
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {}
+
+	// The global default is to keep input; only the foo_total rule overrides it to drop_input.
+	opts := &Options{KeepInput: true}
+	as := mustLoad(t, cfg, pushFunc, opts)
+	defer as.MustStop()
+
+	tss := []prompbmarshal.TimeSeries{
+		mkSeries("foo_total", 1, 1000),
+		mkSeries("bar_total", 2, 1000),
+	}
+	matchIdxs := as.Push(tss, make([]byte, len(tss)))
+	if matchIdxs[0] != 1 {
+		t.Fatalf("foo_total has drop_input: true, which must override the global keep_input default, got matchIdxs[0]=%d", matchIdxs[0])
+	}
+	if matchIdxs[1] != 0 {
+		t.Fatalf("bar_total falls back to the global keep_input default and must not be dropped, got matchIdxs[1]=%d", matchIdxs[1])
+	}
+}
+
+func TestPerRuleDedupIntervalOverride(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [count_samples]
+  dedup_interval: 10s
+`
+	var mu sync.Mutex
+	var lastTss []prompbmarshal.TimeSeries
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {
+		mu.Lock()
+		lastTss = tss
+		mu.Unlock()
+	}
+
+	as := mustLoad(t, cfg, pushFunc, &Options{DedupInterval: 0})
+	defer as.MustStop()
+
+	tss := []prompbmarshal.TimeSeries{
+		mkSeries("foo_total", 1, 1000),
+		mkSeries("foo_total", 1, 2000),
+		mkSeries("foo_total", 1, 20000),
+	}
+	as.Push(tss, make([]byte, len(tss)))
+
+	// Flush the real-time window.
+	as.as[0].flushDue()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lastTss) != 1 {
+		t.Fatalf("expected exactly one output series, got %d", len(lastTss))
+	}
+	got := lastTss[0].Samples[0].Value
+	// The second sample at ts=2000 is within the 10s dedup_interval of the first at ts=1000 and
+	// must be deduplicated; the third at ts=20000 is outside it and must be counted.
+	if got != 2 {
+		t.Fatalf("expected count_samples=2 after dedup, got %v", got)
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [sum]
+`
+	noop := func(tss []prompbmarshal.TimeSeries) {}
+	as := mustLoad(t, cfg, noop, &Options{})
+	defer as.MustStop()
+
+	if !as.MatchesAny("foo_total") {
+		t.Fatalf("expected MatchesAny to report true for a name present in a rule's match list")
+	}
+	if as.MatchesAny("bar_total") {
+		t.Fatalf("expected MatchesAny to report false for a name not matched by any rule")
+	}
+
+	var nilAs *Aggregators
+	if nilAs.MatchesAny("foo_total") {
+		t.Fatalf("expected MatchesAny to report false on a nil *Aggregators, same as Push does")
+	}
+}
+
+func TestAggregatorsEqual(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [sum]
+`
+	noop := func(tss []prompbmarshal.TimeSeries) {}
+	a := mustLoad(t, cfg, noop, &Options{})
+	defer a.MustStop()
+	b := mustLoad(t, cfg, noop, &Options{})
+	defer b.MustStop()
+
+	if !a.Equal(b) {
+		t.Fatalf("expected a and b loaded from identical configs to be Equal")
+	}
+
+	c := mustLoad(t, cfg+"\n- match: [baz_total]\n  interval: 1s\n  outputs: [sum]\n", noop, &Options{})
+	defer c.MustStop()
+	if a.Equal(c) {
+		t.Fatalf("expected a and c loaded from different configs to not be Equal")
+	}
+}
+
+func TestMultipleOutputsPerMatchClauseFanOut(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 1s
+  outputs: [sum, count_samples, avg]
+`
+	var mu sync.Mutex
+	var lastTss []prompbmarshal.TimeSeries
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {
+		mu.Lock()
+		lastTss = tss
+		mu.Unlock()
+	}
+	as := mustLoad(t, cfg, pushFunc, &Options{})
+	defer as.MustStop()
+
+	tss := []prompbmarshal.TimeSeries{
+		mkSeries("foo_total", 2, 1000),
+		mkSeries("foo_total", 4, 2000),
+	}
+	as.Push(tss, make([]byte, len(tss)))
+	as.as[0].flushDue()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lastTss) != 3 {
+		t.Fatalf("expected one output series per configured output (3), got %d", len(lastTss))
+	}
+	got := make(map[string]float64, len(lastTss))
+	for _, ts := range lastTss {
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				got[l.Value] = ts.Samples[0].Value
+			}
+		}
+	}
+	want := map[string]float64{
+		"foo_total:1s_sum":           6,
+		"foo_total:1s_count_samples": 2,
+		"foo_total:1s_avg":           3,
+	}
+	for name, wantValue := range want {
+		gotValue, ok := got[name]
+		if !ok {
+			t.Fatalf("missing output series %q among %v", name, got)
+		}
+		if gotValue != wantValue {
+			t.Fatalf("output series %q: got %v, want %v", name, gotValue, wantValue)
+		}
+	}
+}
+
+func TestFlushLoopRunsOnInterval(t *testing.T) {
+	const cfg = `
+- match: [foo_total]
+  interval: 20ms
+  outputs: [sum]
+`
+	done := make(chan struct{}, 1)
+	pushFunc := func(tss []prompbmarshal.TimeSeries) {
+		select {
+		case done <- struct{}{}:
+		default:
+		}
+	}
+	as := mustLoad(t, cfg, pushFunc, &Options{})
+	defer as.MustStop()
+
+	tss := []prompbmarshal.TimeSeries{mkSeries("foo_total", 1, 1000)}
+	as.Push(tss, make([]byte, len(tss)))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the background flush loop to push the aggregated series")
+	}
+}